@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/doctree/doctree/observability"
+)
+
+// Cache-Control max-age values per endpoint. /api/list and /api/get change
+// only when a project is (re)indexed, so they can be cached longer than
+// /api/search, whose result ranking is more likely to shift meaningfully
+// session-to-session.
+const (
+	listCacheMaxAge   = 60 * time.Second
+	getCacheMaxAge    = 60 * time.Second
+	searchCacheMaxAge = 15 * time.Second
+)
+
+// responseCacheEntry is a single cached handler response: its marshaled
+// body plus the validators needed to answer conditional requests.
+type responseCacheEntry struct {
+	body         []byte
+	contentType  string
+	etag         string
+	lastModified time.Time
+}
+
+// responseCache is a small in-process cache for the JSON endpoints in
+// Serve, keyed by (endpoint, query string). It exists because the SPA polls
+// these endpoints and a CDN fronting doctree needs ETag/Last-Modified to
+// avoid re-fetching bodies that haven't changed.
+type responseCache struct {
+	mu      sync.RWMutex
+	entries map[string]responseCacheEntry
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: map[string]responseCacheEntry{}}
+}
+
+// httpCache backs the JSON endpoints registered in Serve. It's a package
+// var, rather than threaded through every function that can trigger a
+// reindex, since there is exactly one cache per running server.
+var httpCache = newResponseCache()
+
+func cacheKey(endpoint string, r *http.Request) string {
+	return endpoint + "?" + r.URL.RawQuery
+}
+
+func (c *responseCache) get(key string) (responseCacheEntry, bool) {
+	c.mu.RLock()
+	entry, ok := c.entries[key]
+	c.mu.RUnlock()
+
+	if ok {
+		observability.HTTPCacheHitsTotal.Inc()
+	} else {
+		observability.HTTPCacheMissesTotal.Inc()
+	}
+	return entry, ok
+}
+
+func (c *responseCache) set(key string, contentType string, body []byte) responseCacheEntry {
+	sum := sha256.Sum256(body)
+	entry := responseCacheEntry{
+		body:        body,
+		contentType: contentType,
+		etag:        `"` + hex.EncodeToString(sum[:]) + `"`,
+		// The cache is invalidated whenever the underlying project is
+		// reindexed (see invalidateProject), so the moment an entry is
+		// (re)computed is a valid Last-Modified for it.
+		lastModified: time.Now(),
+	}
+
+	c.mu.Lock()
+	c.entries[key] = entry
+	c.mu.Unlock()
+	return entry
+}
+
+// invalidateProject drops every cached entry that could be affected by a
+// reindex of project: /api/list always changes, any /api/get entry whose
+// query string references the project by name, and every /api/search entry
+// since a search query string never names the project(s) it happened to
+// match, so there's no way to scope invalidation more narrowly than "any
+// search result may now be stale."
+func (c *responseCache) invalidateProject(project string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.entries {
+		if strings.HasPrefix(key, "list?") || strings.HasPrefix(key, "search?") || strings.Contains(key, project) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// serveCached answers r from the response cache if present and not modified
+// per If-None-Match/If-Modified-Since, otherwise calls compute to produce
+// the body, caches it, and serves it with Cache-Control tuned by maxAge.
+func serveCached(w http.ResponseWriter, r *http.Request, cache *responseCache, endpoint string, maxAge time.Duration, compute func() ([]byte, error)) {
+	key := cacheKey(endpoint, r)
+
+	entry, ok := cache.get(key)
+	if !ok {
+		body, err := compute()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entry = cache.set(key, "application/json", body)
+	}
+
+	w.Header().Set("ETag", entry.etag)
+	w.Header().Set("Last-Modified", entry.lastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+
+	if match := r.Header.Get("If-None-Match"); match != "" && match == entry.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if since := r.Header.Get("If-Modified-Since"); since != "" {
+		// Last-Modified is sent with whole-second precision, so compare at
+		// that precision; otherwise the client echoing it back never matches.
+		if t, err := http.ParseTime(since); err == nil && !entry.lastModified.Truncate(time.Second).After(t) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", entry.contentType)
+	_, _ = w.Write(entry.body)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeCachedComputesOnceThenHitsCache(t *testing.T) {
+	cache := newResponseCache()
+	calls := 0
+	compute := func() ([]byte, error) {
+		calls++
+		return []byte(`{"ok":true}`), nil
+	}
+
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/api/list", nil)
+		w := httptest.NewRecorder()
+		serveCached(w, r, cache, "list", listCacheMaxAge, compute)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", w.Code)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("compute called %d times, want 1 (subsequent requests should hit the cache)", calls)
+	}
+}
+
+func TestServeCachedIfNoneMatch(t *testing.T) {
+	cache := newResponseCache()
+	compute := func() ([]byte, error) { return []byte(`{"ok":true}`), nil }
+
+	first := httptest.NewRequest(http.MethodGet, "/api/list", nil)
+	w1 := httptest.NewRecorder()
+	serveCached(w1, first, cache, "list", listCacheMaxAge, compute)
+	etag := w1.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag header on the first response")
+	}
+
+	second := httptest.NewRequest(http.MethodGet, "/api/list", nil)
+	second.Header.Set("If-None-Match", etag)
+	w2 := httptest.NewRecorder()
+	serveCached(w2, second, cache, "list", listCacheMaxAge, compute)
+	if w2.Code != http.StatusNotModified {
+		t.Fatalf("status = %d, want 304 for a matching If-None-Match", w2.Code)
+	}
+}
+
+func TestInvalidateProjectDropsListAndSearchButKeepsUnrelatedGet(t *testing.T) {
+	cache := newResponseCache()
+	cache.set("list?", "application/json", []byte("[]"))
+	cache.set("search?query=foo", "application/json", []byte("[]"))
+	cache.set("get?name=other-project", "application/json", []byte("{}"))
+
+	cache.invalidateProject("foo")
+
+	if _, ok := cache.get("list?"); ok {
+		t.Error("list? should always be invalidated")
+	}
+	if _, ok := cache.get("search?query=foo"); ok {
+		t.Error("search? entries should be invalidated on any reindex, since the query string never names a project")
+	}
+	if _, ok := cache.get("get?name=other-project"); !ok {
+		t.Error("get? entries for unrelated projects should survive invalidation")
+	}
+}
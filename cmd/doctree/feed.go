@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EventKind describes what happened to an auto-indexed project.
+type EventKind string
+
+const (
+	EventProjectAdded     EventKind = "added"
+	EventProjectReindexed EventKind = "reindexed"
+	EventProjectRemoved   EventKind = "removed"
+)
+
+// Event is a single entry in the append-only indexing event log, used to
+// drive the Atom feed of "what changed in my docs."
+type Event struct {
+	Kind       EventKind `json:"kind"`
+	Project    string    `json:"project"`
+	Time       time.Time `json:"time"`
+	HashBefore string    `json:"hashBefore,omitempty"`
+	HashAfter  string    `json:"hashAfter,omitempty"`
+}
+
+// eventLogPath returns the path of the append-only event log within dataDir.
+func eventLogPath(dataDir string) string {
+	return filepath.Join(dataDir, "events.log")
+}
+
+// AppendEvent appends a single event to the event log, one JSON object per
+// line so the file can be tailed and read incrementally.
+func AppendEvent(dataDir string, ev Event) error {
+	f, err := os.OpenFile(eventLogPath(dataDir), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "OpenFile")
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(ev); err != nil {
+		return errors.Wrap(err, "Encode")
+	}
+	return nil
+}
+
+// ReadEvents reads all events from the event log, oldest first. A missing
+// log file is treated as an empty event history.
+func ReadEvents(dataDir string) ([]Event, error) {
+	f, err := os.Open(eventLogPath(dataDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Open")
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	// Event lines can carry long docstrings in future event kinds; keep
+	// generous headroom over bufio's 64KiB default.
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return nil, errors.Wrap(err, "Unmarshal")
+		}
+		events = append(events, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Scan")
+	}
+	return events, nil
+}
+
+// Atom feed XML structures, following the Atom 1.0 spec (RFC 4287).
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+// eventTagURI builds a stable tag: URI (RFC 4151) for an event, scoped to
+// the serving host and the project's first-seen date so entries keep a
+// stable identity even if the project is later reindexed or removed.
+func eventTagURI(host, project string, firstSeen time.Time, ev Event) string {
+	return fmt.Sprintf("tag:%s,%04d-%02d-%02d:/projects/%s/events/%d",
+		host, firstSeen.Year(), firstSeen.Month(), firstSeen.Day(), project, ev.Time.Unix())
+}
+
+// buildAtomFeed renders the indexing event log as an Atom 1.0 document.
+// firstSeen maps a project name to the time it was first indexed, used to
+// mint stable tag: URIs for its entries.
+func buildAtomFeed(host string, events []Event, firstSeen map[string]time.Time) []byte {
+	feed := atomFeed{
+		Title: "doctree: indexed project changes",
+		ID:    fmt.Sprintf("tag:%s,%04d:/feed", host, time.Now().Year()),
+		Link:  atomLink{Href: fmt.Sprintf("https://%s/feed.atom", host), Rel: "self"},
+	}
+
+	if len(events) > 0 {
+		feed.Updated = events[len(events)-1].Time.Format(time.RFC3339)
+	} else {
+		feed.Updated = time.Time{}.Format(time.RFC3339)
+	}
+
+	// Most recent events first, matching reader expectations for a feed.
+	for i := len(events) - 1; i >= 0; i-- {
+		ev := events[i]
+		summary := fmt.Sprintf("%s was %s", ev.Project, ev.Kind)
+		if ev.Kind == EventProjectReindexed && ev.HashBefore != "" && ev.HashAfter != "" {
+			summary = fmt.Sprintf("%s was reindexed (%s -> %s)", ev.Project, ev.HashBefore, ev.HashAfter)
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   fmt.Sprintf("%s: %s", ev.Project, ev.Kind),
+			ID:      eventTagURI(host, ev.Project, firstSeen[ev.Project], ev),
+			Updated: ev.Time.Format(time.RFC3339),
+			Link:    atomLink{Href: fmt.Sprintf("https://%s/%s", host, ev.Project)},
+			Summary: summary,
+		})
+	}
+
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		// atomFeed only contains strings built from well-formed data above,
+		// so marshaling cannot fail in practice.
+		panic(err)
+	}
+	return append([]byte(xml.Header), out...)
+}
+
+// feedHandler serves the Atom feed of indexing events for projects stored
+// under dataDir.
+func feedHandler(dataDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		events, err := ReadEvents(dataDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		firstSeen := map[string]time.Time{}
+		for _, ev := range events {
+			if _, ok := firstSeen[ev.Project]; !ok {
+				firstSeen[ev.Project] = ev.Time
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		_, _ = w.Write(buildAtomFeed(r.Host, events, firstSeen))
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestBuildAtomFeedOrdersNewestFirst(t *testing.T) {
+	t1 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	events := []Event{
+		{Kind: EventProjectAdded, Project: "foo", Time: t1},
+		{Kind: EventProjectReindexed, Project: "foo", Time: t2, HashBefore: "aaa", HashAfter: "bbb"},
+	}
+	firstSeen := map[string]time.Time{"foo": t1}
+
+	out := buildAtomFeed("doctree.org", events, firstSeen)
+
+	var feed atomFeed
+	if err := xml.Unmarshal(out, &feed); err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(feed.Entries))
+	}
+	if feed.Entries[0].Title != "foo: reindexed" {
+		t.Fatalf("newest entry title = %q, want the reindex listed first", feed.Entries[0].Title)
+	}
+	if feed.Entries[1].Title != "foo: added" {
+		t.Fatalf("oldest entry title = %q, want the added event listed last", feed.Entries[1].Title)
+	}
+}
+
+func TestBuildAtomFeedReindexSummaryIncludesHashes(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []Event{{Kind: EventProjectReindexed, Project: "foo", Time: now, HashBefore: "aaa", HashAfter: "bbb"}}
+
+	var feed atomFeed
+	if err := xml.Unmarshal(buildAtomFeed("doctree.org", events, map[string]time.Time{"foo": now}), &feed); err != nil {
+		t.Fatal(err)
+	}
+	want := "foo was reindexed (aaa -> bbb)"
+	if feed.Entries[0].Summary != want {
+		t.Fatalf("Summary = %q, want %q", feed.Entries[0].Summary, want)
+	}
+}
+
+func TestBuildAtomFeedEmpty(t *testing.T) {
+	out := buildAtomFeed("doctree.org", nil, nil)
+
+	var feed atomFeed
+	if err := xml.Unmarshal(out, &feed); err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Entries) != 0 {
+		t.Fatalf("got %d entries, want 0 for an empty event log", len(feed.Entries))
+	}
+}
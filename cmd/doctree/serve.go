@@ -5,24 +5,36 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/NYTimes/gziphandler"
 	"github.com/fsnotify/fsnotify"
 	"github.com/hexops/cmder"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sourcegraph/doctree/doctree/indexer"
+	"github.com/sourcegraph/doctree/doctree/indexer/search"
+	"github.com/sourcegraph/doctree/doctree/observability"
 	"github.com/sourcegraph/doctree/frontend"
 )
 
+// logger is the structured logger used throughout the serve command. It's
+// reconfigured (level/JSON-ness) in the serve subcommand's handler before
+// ListenAutoIndexedProjects and Serve start, and read thereafter.
+var logger = observability.NewLogger(observability.LevelInfo, false)
+
 func init() {
 	const usage = `
 Examples:
@@ -42,18 +54,74 @@ Examples:
 	dataDirFlag := flagSet.String("data-dir", defaultDataDir(), "where doctree stores its data")
 	httpFlag := flagSet.String("http", ":3333", "address to bind for the HTTP server")
 	cloudModeFlag := flagSet.Bool("cloud", false, "run in cloud mode (i.e. doctree.org)")
+	ignoreFlag := flagSet.String("ignore", "", "comma-separated list of additional glob patterns to exclude from auto-index watching")
+	metricsBindFlag := flagSet.String("metrics-bind", "", "address to bind for the /metrics endpoint (defaults to the main HTTP address, or 127.0.0.1:6060 in cloud mode)")
+	logJSONFlag := flagSet.Bool("log-json", false, "emit structured logs as JSON lines instead of human-readable text")
+	drainTimeoutFlag := flagSet.Duration("drain-timeout", 30*time.Second, "how long to wait for in-flight requests and indexer runs to finish during shutdown")
 
 	// Handles calls to our subcommand.
 	handler := func(args []string) error {
 		_ = flagSet.Parse(args)
 		indexDataDir := filepath.Join(*dataDirFlag, "index")
+		ignoreGlobs := strings.Split(*ignoreFlag, ",")
+		logger = observability.NewLogger(observability.LevelInfo, *logJSONFlag)
+
+		metricsBind := *metricsBindFlag
+		if metricsBind == "" && *cloudModeFlag {
+			metricsBind = "127.0.0.1:6060"
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
 
 		signals := make(chan os.Signal, 1)
 		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-		go ListenAutoIndexedProjects(dataDirFlag)
-		go Serve(*cloudModeFlag, *httpFlag, indexDataDir)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ListenAutoIndexedProjects(ctx, dataDirFlag, ignoreGlobs, reload, &wg); err != nil {
+				logger.Error(ctx, "ListenAutoIndexedProjects: %s", err)
+			}
+		}()
+
+		srv := NewServer(ctx, *cloudModeFlag, *httpFlag, *dataDirFlag, indexDataDir, metricsBind)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger.Info(ctx, "Listening on %s", *httpFlag)
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error(ctx, "ListenAndServe: %s", err)
+			}
+		}()
+
 		<-signals
+		logger.Info(ctx, "shutting down")
+
+		// Shut down the HTTP server (letting in-flight requests finish)
+		// before canceling ctx, since ctx is also the request BaseContext:
+		// canceling it first would abort every in-flight request instead
+		// of letting them drain.
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), *drainTimeoutFlag)
+		defer shutdownCancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Error(ctx, "HTTP server shutdown: %s", err)
+		}
+		cancel()
+
+		drained := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-shutdownCtx.Done():
+			logger.Warn(ctx, "drain timeout exceeded, exiting with work still in flight")
+		}
 
 		return nil
 	}
@@ -71,11 +139,36 @@ Examples:
 	})
 }
 
-// Serve an HTTP server on the given addr.
-func Serve(cloudMode bool, addr, indexDataDir string) error {
-	log.Printf("Listening on %s", addr)
+// NewServer builds (but does not start) the doctree HTTP server for addr.
+// The returned server's BaseContext is ctx, so canceling ctx propagates to
+// every in-flight request's Context() (in particular searchWithTrigramIndex),
+// and the caller can later call Shutdown on it for
+// a graceful drain. If metricsBind is non-empty, the /metrics endpoint is
+// served from that address instead of addr (so it can be scoped to
+// loopback in cloud mode) via its own server, also tied to ctx; otherwise
+// it's mounted on addr alongside the rest of the API.
+func NewServer(ctx context.Context, cloudMode bool, addr, dataDir, indexDataDir, metricsBind string) *http.Server {
 	mux := http.NewServeMux()
 	mux.Handle("/", frontendHandler())
+	mux.Handle("/api/feed", feedHandler(dataDir))
+	mux.Handle("/feed.atom", feedHandler(dataDir))
+	if metricsBind == "" {
+		mux.Handle("/metrics", promhttp.HandlerFor(observability.Registry, promhttp.HandlerOpts{}))
+	} else {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.HandlerFor(observability.Registry, promhttp.HandlerOpts{}))
+		metricsSrv := &http.Server{Addr: metricsBind, Handler: metricsMux, BaseContext: func(net.Listener) context.Context { return ctx }}
+		go func() {
+			logger.Info(ctx, "Serving /metrics on %s", metricsBind)
+			if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error(ctx, "metrics server: %s", err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			_ = metricsSrv.Close()
+		}()
+	}
 	mux.Handle("/main.js", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		flags := struct {
 			CloudMode bool `json:"cloudMode"`
@@ -94,72 +187,153 @@ func Serve(cloudMode bool, addr, indexDataDir string) error {
 		// SECURITY: This endpoint isn't mutable and doesn't serve privileged information, and
 		// therefor safe to use from any origin.
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Content-Type", "application/json")
 
-		indexes, err := indexer.List(indexDataDir)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		b, err := json.Marshal(indexes)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		_, err = w.Write(b)
-		if err != nil {
-			return
-		}
+		serveCached(w, r, httpCache, "list", listCacheMaxAge, func() ([]byte, error) {
+			indexes, err := indexer.List(indexDataDir)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(indexes)
+		})
 	}))
 	mux.Handle("/api/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// SECURITY: This endpoint isn't mutable and doesn't serve privileged information, and
 		// therefor safe to use from any origin.
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Content-Type", "application/json")
 
-		projectName := r.URL.Query().Get("name")
-		projectIndexes, err := indexer.Get(indexDataDir, projectName)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		b, err := json.Marshal(projectIndexes)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		_, err = w.Write(b)
-		if err != nil {
-			return
-		}
+		serveCached(w, r, httpCache, "get", getCacheMaxAge, func() ([]byte, error) {
+			projectName := r.URL.Query().Get("name")
+			projectIndexes, err := indexer.Get(indexDataDir, projectName)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(projectIndexes)
+		})
 	}))
 	mux.Handle("/api/search", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// SECURITY: This endpoint isn't mutable and doesn't serve privileged information, and
 		// therefor safe to use from any origin.
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Content-Type", "application/json")
 
 		query := r.URL.Query().Get("query")
-		results, err := indexer.Search(r.Context(), indexDataDir, query)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+		observability.SearchQueryLength.Observe(float64(len(query)))
+
+		serveCached(w, r, httpCache, "search", searchCacheMaxAge, func() ([]byte, error) {
+			start := time.Now()
+			results, err := searchWithTrigramIndex(r.Context(), indexDataDir, query)
+			if err != nil {
+				return nil, err
+			}
+			observability.SearchQueryDuration.Observe(time.Since(start).Seconds())
+			observability.SearchResultCount.Observe(float64(len(results)))
+			return json.Marshal(results)
+		})
+	}))
+	instrumented := instrumentRequests(mux)
+	muxWithGzip := gziphandler.GzipHandler(instrumented)
+	return &http.Server{
+		Addr:        addr,
+		Handler:     muxWithGzip,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+}
+
+// instrumentRequests wraps next with a request ID (propagated via context,
+// so handlers and their logs can correlate) and Prometheus request
+// count/latency metrics.
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqID := observability.NewRequestID()
+		ctx := observability.WithRequestID(r.Context(), reqID)
+		r = r.WithContext(ctx)
+		w.Header().Set("X-Request-Id", reqID)
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		logger.Info(ctx, "%s %s %d (%s)", r.Method, r.URL.Path, rec.status, time.Since(start))
+		observability.HTTPRequestsTotal.WithLabelValues(r.URL.Path, r.Method, strconv.Itoa(rec.status)).Inc()
+		observability.HTTPRequestDuration.WithLabelValues(r.URL.Path, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
 
-		b, err := json.Marshal(results)
+// statusRecorder captures the status code written by a handler, since
+// http.ResponseWriter doesn't expose it directly.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// searchWithTrigramIndex answers a search query using the persisted trigram
+// index for each indexed project, falling back to an index built in memory
+// for any project that doesn't have a persisted trigram shard yet (e.g. it
+// was just added and hasn't been reindexed, or was indexed before this index
+// type was introduced). The fallback is scoped to that one project, not the
+// whole request, so the response is always []search.Result regardless of
+// which projects happen to have a shard on disk.
+func searchWithTrigramIndex(ctx context.Context, indexDataDir, query string) ([]search.Result, error) {
+	projects, err := indexer.List(indexDataDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "List")
+	}
+
+	var merged []search.Result
+	for _, project := range projects {
+		idx, err := search.Load(indexDataDir, project.Name)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			docs, err := documentsForProject(indexDataDir, project.Name)
+			if err != nil {
+				return nil, errors.Wrap(err, "documentsForProject")
+			}
+			idx = search.Build(docs)
 		}
-		_, err = w.Write(b)
+		results, err := idx.Query(ctx, query)
 		if err != nil {
-			return
+			return nil, errors.Wrap(err, "Query")
 		}
-	}))
-	muxWithGzip := gziphandler.GzipHandler(mux)
-	if err := http.ListenAndServe(addr, muxWithGzip); err != nil {
-		return errors.Wrap(err, "ListenAndServe")
+		merged = append(merged, results...)
 	}
-	return nil
+
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Score > merged[j].Score })
+	return merged, nil
+}
+
+// rebuildTrigramIndex rebuilds and persists the trigram index for a single
+// project. It's called whenever ListenAutoIndexedProjects triggers a
+// reindex so the trigram shard never drifts from the underlying JSON index.
+func rebuildTrigramIndex(indexDataDir, project string) error {
+	docs, err := documentsForProject(indexDataDir, project)
+	if err != nil {
+		return errors.Wrap(err, "documentsForProject")
+	}
+	return search.Save(indexDataDir, project, search.Build(docs))
+}
+
+// documentsForProject extracts one search.Document per symbol name,
+// docstring, and file path from a project's indexed pages.
+func documentsForProject(indexDataDir, project string) ([]search.Document, error) {
+	projectIndexes, err := indexer.Get(indexDataDir, project)
+	if err != nil {
+		return nil, errors.Wrap(err, "Get")
+	}
+
+	var docs []search.Document
+	for _, page := range projectIndexes.Pages {
+		docs = append(docs, search.Document{Project: project, Path: page.Path, Name: page.Path, Kind: "path"})
+		for _, sec := range page.Sections {
+			docs = append(docs, search.Document{Project: project, Path: page.Path, Name: sec.Name, Kind: "symbol"})
+			if sec.Docstring != "" {
+				docs = append(docs, search.Document{Project: project, Path: page.Path, Name: sec.Name, Docstring: sec.Docstring, Kind: "docstring"})
+			}
+		}
+	}
+	return docs, nil
 }
 
 func frontendHandler() http.Handler {
@@ -213,29 +387,41 @@ func isParentDir(parent, child string) (bool, error) {
 	return !strings.Contains(relativePath, ".."), nil
 }
 
-func ListenAutoIndexedProjects(dataDirFlag *string) error {
+// ListenAutoIndexedProjects watches every auto-indexed project for changes
+// until ctx is canceled. Each reindex it triggers is tracked on wg, so a
+// caller doing a graceful shutdown can wait for outstanding reindexes to
+// finish draining. A SIGHUP delivered on reload re-reads the autoindex file
+// and adds/removes watches for projects added or removed from it, without
+// restarting the process.
+func ListenAutoIndexedProjects(ctx context.Context, dataDirFlag *string, ignoreGlobs []string, reload <-chan os.Signal, wg *sync.WaitGroup) error {
 	// Read the list of projects to monitor.
 	autoIndexPath := filepath.Join(*dataDirFlag, "autoindex")
+	indexDataDir := filepath.Join(*dataDirFlag, "index")
 	autoindexProjects, err := ReadAutoIndex(autoIndexPath)
 	if err != nil {
-		log.Fatal(err)
+		return errors.Wrap(err, "ReadAutoIndex")
 	}
 
 	// Initialize the fsnotify watcher
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatal(err)
+		return errors.Wrap(err, "NewWatcher")
 	}
 
-	// Configure watcher to watch all dirs mentioned in the 'autoindex' file
+	// Reindex and recursively watch every dir mentioned in the 'autoindex' file.
 	for i, project := range autoindexProjects {
 		if GetDirHash(project.Path) != project.Hash {
-			log.Printf("Project %s has been modified while server was down, reindexing", project.Name)
-			ctx := context.Background()
-			if err != nil {
-				log.Fatal(err)
+			logger.Info(ctx, "Project %s has been modified while server was down, reindexing", project.Name)
+			hashBefore := project.Hash
+			runIndexersInstrumented(ctx, project.Path, dataDirFlag, &project.Name)
+			if err := rebuildTrigramIndex(indexDataDir, project.Name); err != nil {
+				logger.Warn(ctx, "rebuilding trigram index: %s", err)
+			}
+			httpCache.invalidateProject(project.Name)
+			ev := Event{Kind: EventProjectReindexed, Project: project.Name, Time: time.Now(), HashBefore: hashBefore, HashAfter: GetDirHash(project.Path)}
+			if err := AppendEvent(*dataDirFlag, ev); err != nil {
+				logger.Warn(ctx, "appending event: %s", err)
 			}
-			RunIndexers(ctx, project.Path, dataDirFlag, &project.Name)
 
 			// Update the autoIndexedProjects array
 			autoindexProjectPtr := &autoindexProjects[i]
@@ -243,13 +429,13 @@ func ListenAutoIndexedProjects(dataDirFlag *string) error {
 			WriteAutoIndex(autoIndexPath, autoindexProjects)
 		}
 
-		// Add the project directory to the watcher
-		// TODO: Watch nested directories
-		err = watcher.Add(project.Path)
-		if err != nil {
-			log.Fatal(err)
+		// A transient failure watching one project (e.g. a dir removed mid-walk)
+		// shouldn't take down the whole server; log and keep starting the rest.
+		if err := addRecursive(watcher, project.Path, ignoreGlobs); err != nil {
+			logger.Error(ctx, "watching %s: %s", project.Name, err)
+			continue
 		}
-		log.Println("Watching", project)
+		logger.Info(ctx, "Watching %s", project.Name)
 	}
 
 	f, err := os.Create(autoIndexPath)
@@ -262,38 +448,74 @@ func ListenAutoIndexedProjects(dataDirFlag *string) error {
 		return errors.Wrap(err, "Encode")
 	}
 
-	done := make(chan error)
-
-	// Process events
-	go func() {
-		for {
-			select {
-			case ev := <-watcher.Events:
-				log.Println("Event:", ev)
-				for _, dir := range autoindexProjects {
-					isParent, err := isParentDir(dir.Path, ev.Name)
-					if err != nil {
-						log.Println(err)
-						return
-					}
-					if isParent {
-						log.Println("Reindexing", dir)
-						ctx := context.Background()
-						if err != nil {
-							log.Println(err)
-							return
-						}
-						RunIndexers(ctx, dir.Path, dataDirFlag, &dir.Name)
-						break // Only reindex for the first matching parent
-					}
-				}
-			case err := <-watcher.Errors:
-				log.Println("Error:", err)
-			}
-		}
-	}()
-	<-done
+	watchProjects(ctx, watcher, *dataDirFlag, indexDataDir, autoIndexPath, autoindexProjects, ignoreGlobs, reload, wg)
 
 	watcher.Close()
 	return nil
 }
+
+// reconcileWatchedProjects diffs current (the projects watchProjects knows
+// about) against what's now in the autoindex file, adding recursive watches
+// and an initial index for newly-added projects, and removing watches for
+// deleted ones. It returns the updated project list.
+func reconcileWatchedProjects(ctx context.Context, watcher *fsnotify.Watcher, dataDir, indexDataDir, autoIndexPath string, current []AutoIndexedProject, ignoreGlobs []string) []AutoIndexedProject {
+	updated, err := ReadAutoIndex(autoIndexPath)
+	if err != nil {
+		logger.Error(ctx, "reloading autoindex: %s", err)
+		return current
+	}
+
+	stillPresent := map[string]bool{}
+	for _, project := range updated {
+		stillPresent[project.Name] = true
+	}
+	for _, project := range current {
+		if !stillPresent[project.Name] {
+			logger.Info(ctx, "no longer watching %s (removed from autoindex)", project.Name)
+			removeRecursive(watcher, project.Path)
+
+			ev := Event{Kind: EventProjectRemoved, Project: project.Name, Time: time.Now()}
+			if err := AppendEvent(dataDir, ev); err != nil {
+				logger.Warn(ctx, "appending event: %s", err)
+			}
+		}
+	}
+
+	wasPresent := map[string]bool{}
+	for _, project := range current {
+		wasPresent[project.Name] = true
+	}
+	for i, project := range updated {
+		if wasPresent[project.Name] {
+			continue
+		}
+		logger.Info(ctx, "watching new auto-indexed project %s", project.Name)
+		if err := addRecursive(watcher, project.Path, ignoreGlobs); err != nil {
+			logger.Error(ctx, "watching %s: %s", project.Name, err)
+		}
+
+		// Newly-added projects haven't been indexed yet, unlike ones
+		// ListenAutoIndexedProjects already reindexed-if-stale at startup;
+		// index them now so they show up in /api/list and /api/search
+		// immediately rather than waiting on their first filesystem event.
+		logger.Info(ctx, "Indexing new project %s", project.Name)
+		hashBefore := project.Hash
+		runIndexersInstrumented(ctx, project.Path, &dataDir, &project.Name)
+		if err := rebuildTrigramIndex(indexDataDir, project.Name); err != nil {
+			logger.Warn(ctx, "rebuilding trigram index: %s", err)
+		}
+		httpCache.invalidateProject(project.Name)
+
+		updated[i].Hash = GetDirHash(project.Path)
+		// Newly-discovered, not a reindex of a known project: record it as
+		// "added" so the feed distinguishes it from later reindexes.
+		ev := Event{Kind: EventProjectAdded, Project: project.Name, Time: time.Now(), HashBefore: hashBefore, HashAfter: updated[i].Hash}
+		if err := AppendEvent(dataDir, ev); err != nil {
+			logger.Warn(ctx, "appending event: %s", err)
+		}
+	}
+
+	WriteAutoIndex(autoIndexPath, updated)
+
+	return updated
+}
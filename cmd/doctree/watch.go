@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/doctree/doctree/observability"
+)
+
+// Debounce tuning for coalescing bursts of filesystem events (e.g. a
+// `go build` or editor save) into a single reindex.
+const (
+	debounceQuietPeriod = 2 * time.Second
+	debounceMaxDelay    = 30 * time.Second
+)
+
+// defaultIgnoredDirs are always skipped when recursively watching a
+// project, in addition to any user-supplied globs.
+var defaultIgnoredDirs = []string{".git", "node_modules", "vendor"}
+
+// isIgnoredDir reports whether dir (an absolute path) should be excluded
+// from watching, either because its base name matches one of the default
+// ignored directory names or because it matches one of the user-supplied
+// glob patterns.
+func isIgnoredDir(dir string, ignoreGlobs []string) bool {
+	base := filepath.Base(dir)
+	for _, name := range defaultIgnoredDirs {
+		if base == name {
+			return true
+		}
+	}
+	for _, pattern := range ignoreGlobs {
+		if pattern == "" {
+			continue
+		}
+		if matched, _ := filepath.Match(pattern, base); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, dir); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// addRecursive adds root and every non-ignored subdirectory beneath it to
+// watcher, so events fire for nested directories (fsnotify itself is not
+// recursive).
+func addRecursive(watcher *fsnotify.Watcher, root string, ignoreGlobs []string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && isIgnoredDir(path, ignoreGlobs) {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			return errors.Wrapf(err, "watcher.Add(%s)", path)
+		}
+		return nil
+	})
+}
+
+// removeRecursive removes root and every subdirectory beneath it from
+// watcher. Errors are ignored: fsnotify returns an error for paths it isn't
+// watching, which is the common case here (e.g. a dir that was ignored).
+func removeRecursive(watcher *fsnotify.Watcher, root string) {
+	// root may already be gone (a Remove event), in which case the walk
+	// below cannot visit it.
+	_ = watcher.Remove(root)
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		_ = watcher.Remove(path)
+		return nil
+	})
+}
+
+// reindexDebouncer coalesces bursts of filesystem events per-project into a
+// single reindex call: it waits for quietPeriod of silence, but fires no
+// later than maxDelay after the first event in a burst.
+type reindexDebouncer struct {
+	mu          sync.Mutex
+	bursts      map[string]*debounceBurst
+	quietPeriod time.Duration
+	maxDelay    time.Duration
+}
+
+type debounceBurst struct {
+	quietTimer *time.Timer
+	maxTimer   *time.Timer
+	once       sync.Once
+}
+
+func newReindexDebouncer() *reindexDebouncer {
+	return newReindexDebouncerWithTiming(debounceQuietPeriod, debounceMaxDelay)
+}
+
+// newReindexDebouncerWithTiming is newReindexDebouncer with overridable
+// timing, so tests can exercise quiet-period and max-delay behavior without
+// waiting on the production durations.
+func newReindexDebouncerWithTiming(quietPeriod, maxDelay time.Duration) *reindexDebouncer {
+	return &reindexDebouncer{bursts: map[string]*debounceBurst{}, quietPeriod: quietPeriod, maxDelay: maxDelay}
+}
+
+// trigger schedules fn to run after the project's event burst settles. Safe
+// to call concurrently and repeatedly while events keep arriving. wg.Add(1)
+// is called exactly once per burst (when it starts) and wg.Done() exactly
+// once when fn finally runs, so a caller can wg.Wait() for every pending
+// reindex to drain during shutdown.
+func (d *reindexDebouncer) trigger(project string, wg *sync.WaitGroup, fn func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	burst, ok := d.bursts[project]
+	if !ok {
+		burst = &debounceBurst{}
+		d.bursts[project] = burst
+		wg.Add(1)
+	}
+
+	fire := func() {
+		// Stop the sibling timer so an orphaned quiet/max timer from this
+		// same burst can't fire later and, after this burst has already
+		// been deleted and possibly replaced by a newer one for the same
+		// project, delete that newer burst's live map entry out from under
+		// it.
+		d.mu.Lock()
+		burst.quietTimer.Stop()
+		burst.maxTimer.Stop()
+		d.mu.Unlock()
+
+		burst.once.Do(func() {
+			defer wg.Done()
+			fn()
+		})
+
+		d.mu.Lock()
+		if d.bursts[project] == burst {
+			delete(d.bursts, project)
+		}
+		d.mu.Unlock()
+	}
+
+	if burst.quietTimer != nil {
+		burst.quietTimer.Stop()
+	}
+	burst.quietTimer = time.AfterFunc(d.quietPeriod, fire)
+
+	if burst.maxTimer == nil {
+		burst.maxTimer = time.AfterFunc(d.maxDelay, fire)
+	}
+}
+
+// runIndexersInstrumented calls RunIndexers while recording its duration and
+// outcome as Prometheus metrics. RunIndexers indexes every language it finds
+// in a single pass, so runs are labeled "multiple" rather than by a single
+// language.
+func runIndexersInstrumented(ctx context.Context, path string, dataDirFlag *string, name *string) {
+	const language = "multiple"
+	start := time.Now()
+	RunIndexers(ctx, path, dataDirFlag, name)
+	observability.IndexerRunsTotal.WithLabelValues(*name, language).Inc()
+	observability.IndexerRunDuration.WithLabelValues(*name, language).Observe(time.Since(start).Seconds())
+}
+
+// reindexProject reindexes a single auto-indexed project, rebuilding its
+// trigram index and recording a "reindexed" event, but only if its
+// directory hash actually changed since the last index (a debounced burst
+// may settle back to a no-op, e.g. a file saved and then reverted).
+func reindexProject(ctx context.Context, dataDir, indexDataDir string, project *AutoIndexedProject) {
+	hashBefore := project.Hash
+	hashAfter := GetDirHash(project.Path)
+	if hashAfter == hashBefore {
+		logger.Info(ctx, "Project %s unchanged after debounce, skipping reindex", project.Name)
+		observability.WatcherEventsDebouncedTotal.Inc()
+		return
+	}
+
+	observability.WatcherReindexTriggeredTotal.Inc()
+	logger.Info(ctx, "Reindexing %s", project.Name)
+	dataDirFlag := &dataDir
+	runIndexersInstrumented(ctx, project.Path, dataDirFlag, &project.Name)
+	if err := rebuildTrigramIndex(indexDataDir, project.Name); err != nil {
+		logger.Warn(ctx, "rebuilding trigram index: %s", err)
+	}
+	httpCache.invalidateProject(project.Name)
+
+	project.Hash = GetDirHash(project.Path)
+	ev := Event{Kind: EventProjectReindexed, Project: project.Name, Time: time.Now(), HashBefore: hashBefore, HashAfter: project.Hash}
+	if err := AppendEvent(dataDir, ev); err != nil {
+		logger.Warn(ctx, "appending event: %s", err)
+	}
+}
+
+// watchProjects recursively watches every auto-indexed project for changes,
+// coalescing bursts of events into debounced, per-project reindexes. It
+// returns when ctx is canceled. Each debounced reindex is tracked on wg so a
+// caller can wait for outstanding work to drain during shutdown. A signal
+// received on reload re-reads the autoindex file and reconciles watched
+// directories against it, without restarting the process.
+func watchProjects(ctx context.Context, watcher *fsnotify.Watcher, dataDir, indexDataDir, autoIndexPath string, autoindexProjects []AutoIndexedProject, ignoreGlobs []string, reload <-chan os.Signal, wg *sync.WaitGroup) {
+	debouncer := newReindexDebouncer()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			logger.Info(ctx, "SIGHUP received, reloading autoindex")
+			autoindexProjects = reconcileWatchedProjects(ctx, watcher, dataDir, indexDataDir, autoIndexPath, autoindexProjects, ignoreGlobs)
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			logger.Info(ctx, "Event: %v", ev)
+			observability.WatcherEventsBatchedTotal.Inc()
+
+			for i := range autoindexProjects {
+				project := &autoindexProjects[i]
+				isParent, err := isParentDir(project.Path, ev.Name)
+				if err != nil {
+					logger.Warn(ctx, "%s", err)
+					continue
+				}
+				if !isParent {
+					continue
+				}
+
+				// Keep the recursive watch in sync with directories created
+				// or removed during the burst.
+				if ev.Op&fsnotify.Create != 0 {
+					if info, err := os.Stat(ev.Name); err == nil && info.IsDir() && !isIgnoredDir(ev.Name, ignoreGlobs) {
+						if err := addRecursive(watcher, ev.Name, ignoreGlobs); err != nil {
+							logger.Warn(ctx, "watching new directory: %s", err)
+						}
+					}
+				}
+				if ev.Op&fsnotify.Remove != 0 {
+					removeRecursive(watcher, ev.Name)
+				}
+
+				debouncer.trigger(project.Name, wg, func() {
+					reindexProject(ctx, dataDir, indexDataDir, project)
+					WriteAutoIndex(autoIndexPath, autoindexProjects)
+				})
+				break // Only reindex for the first matching parent
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warn(ctx, "watcher error: %s", err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestReindexDebouncerCoalescesBurst(t *testing.T) {
+	d := newReindexDebouncer()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	calls := 0
+
+	fn := func() {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	}
+
+	// Fire several events in quick succession, well inside debounceQuietPeriod
+	// of each other; they should coalesce into a single call.
+	for i := 0; i < 5; i++ {
+		d.trigger("proj", &wg, fn)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	waitTimeout(t, &wg, debounceQuietPeriod+time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Fatalf("fn called %d times, want exactly 1 for a coalesced burst", calls)
+	}
+}
+
+func TestReindexDebouncerSeparateProjectsDontCoalesce(t *testing.T) {
+	d := newReindexDebouncer()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := map[string]int{}
+
+	fn := func(project string) func() {
+		return func() {
+			mu.Lock()
+			seen[project]++
+			mu.Unlock()
+		}
+	}
+
+	d.trigger("a", &wg, fn("a"))
+	d.trigger("b", &wg, fn("b"))
+
+	waitTimeout(t, &wg, debounceQuietPeriod+time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if seen["a"] != 1 || seen["b"] != 1 {
+		t.Fatalf("seen = %+v, want exactly one fire per project", seen)
+	}
+}
+
+func waitTimeout(t *testing.T, wg *sync.WaitGroup, timeout time.Duration) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for debounced reindex to fire")
+	}
+}
+
+// TestReindexDebouncerOrphanedMaxTimerDoesNotStealNewerBurst guards against a
+// regression where a burst's maxTimer, left running after its quietTimer
+// already resolved the burst, later fires and deletes a *different*,
+// still-live burst that has since taken the same map slot. That premature
+// delete would make the next trigger() think no burst is in flight and start
+// a fresh one, splitting what should be one coalesced reindex into two.
+func TestReindexDebouncerOrphanedMaxTimerDoesNotStealNewerBurst(t *testing.T) {
+	const quiet = 40 * time.Millisecond
+	const max = 70 * time.Millisecond
+	d := newReindexDebouncerWithTiming(quiet, max)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	calls := 0
+	fn := func() {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	}
+
+	// Burst A: a single isolated event that settles on its own via its quiet
+	// timer, at t=40ms, leaving its maxTimer (armed for t=70ms) with nothing
+	// left to do.
+	d.trigger("proj", &wg, fn)
+	time.Sleep(50 * time.Millisecond) // t=50ms: A has resolved
+
+	// Burst B starts right after A resolved, while A's orphaned maxTimer
+	// (due at t=70ms) is still pending.
+	d.trigger("proj", &wg, fn)
+	time.Sleep(10 * time.Millisecond) // t=60ms
+	d.trigger("proj", &wg, fn)        // keep B alive, reset its quiet timer
+
+	// Let A's original maxTimer deadline (t=70ms) pass, then send one more
+	// event for B, as if a new filesystem event arrived right after it.
+	time.Sleep(15 * time.Millisecond) // t=75ms
+	d.trigger("proj", &wg, fn)
+
+	waitTimeout(t, &wg, 2*time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Fatalf("fn called %d times, want exactly 2 (one for the isolated burst, one for the coalesced burst)", calls)
+	}
+}
+
+func TestIsIgnoredDir(t *testing.T) {
+	tests := []struct {
+		dir         string
+		ignoreGlobs []string
+		want        bool
+	}{
+		{"/repo/.git", nil, true},
+		{"/repo/node_modules", nil, true},
+		{"/repo/vendor", nil, true},
+		{"/repo/src", nil, false},
+		{"/repo/build", []string{"build"}, true},
+		{"/repo/src", []string{"build"}, false},
+	}
+	for _, tt := range tests {
+		if got := isIgnoredDir(tt.dir, tt.ignoreGlobs); got != tt.want {
+			t.Errorf("isIgnoredDir(%q, %v) = %v, want %v", tt.dir, tt.ignoreGlobs, got, tt.want)
+		}
+	}
+}
+
+// newWatchProjectsTestDir writes an empty autoindex file (no projects
+// configured) so watchProjects/reconcileWatchedProjects can run without
+// exercising RunIndexers, which these tests aren't concerned with.
+func newWatchProjectsTestDir(t *testing.T) (dir, autoIndexPath, indexDataDir string) {
+	t.Helper()
+	dir = t.TempDir()
+	autoIndexPath = filepath.Join(dir, "autoindex")
+	indexDataDir = filepath.Join(dir, "index")
+	WriteAutoIndex(autoIndexPath, nil)
+	return dir, autoIndexPath, indexDataDir
+}
+
+func TestWatchProjectsStopsOnContextCancel(t *testing.T) {
+	dir, autoIndexPath, indexDataDir := newWatchProjectsTestDir(t)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := make(chan os.Signal, 1)
+	var wg sync.WaitGroup
+
+	done := make(chan struct{})
+	go func() {
+		watchProjects(ctx, watcher, dir, indexDataDir, autoIndexPath, nil, nil, reload, &wg)
+		close(done)
+	}()
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("watchProjects did not return after its context was canceled")
+	}
+}
+
+func TestWatchProjectsReloadTriggersReconcile(t *testing.T) {
+	dir, autoIndexPath, indexDataDir := newWatchProjectsTestDir(t)
+
+	before, err := os.Stat(autoIndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := make(chan os.Signal, 1)
+	var wg sync.WaitGroup
+
+	done := make(chan struct{})
+	go func() {
+		watchProjects(ctx, watcher, dir, indexDataDir, autoIndexPath, nil, nil, reload, &wg)
+		close(done)
+	}()
+
+	// Give watchProjects a moment to be blocked on its select before
+	// signaling, and put some daylight between this mtime and the initial
+	// write on filesystems with coarse mtime resolution.
+	time.Sleep(10 * time.Millisecond)
+	reload <- os.Interrupt
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		after, err := os.Stat(autoIndexPath)
+		if err == nil && after.ModTime().After(before.ModTime()) {
+			cancel()
+			<-done
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	t.Fatal("autoindex file was never rewritten after a reload signal; reconcileWatchedProjects did not run")
+}
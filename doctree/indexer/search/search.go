@@ -0,0 +1,269 @@
+// Package search implements a trigram-based inverted index over symbol
+// names, docstrings, and file paths produced by the doctree indexer. It lets
+// /api/search avoid a full linear scan of every indexed project on every
+// request.
+package search
+
+import (
+	"context"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Document is a single searchable unit extracted from an indexed project:
+// a symbol name, a docstring, or a file path. Kind is used to prioritize
+// ranking (e.g. a symbol name match outranks a docstring match). Name always
+// carries a short identifier suitable for display (the symbol name, or the
+// path itself for path documents) even for docstring documents, whose
+// searchable text lives in Docstring instead.
+type Document struct {
+	Project   string
+	Path      string // file path the document was extracted from
+	Name      string // symbol name, or the path itself for path documents
+	Docstring string // searchable text for "docstring" documents; empty otherwise
+	Kind      string // "symbol", "docstring", or "path"
+}
+
+// text returns the string doc is indexed and matched against: its docstring
+// text for docstring documents (which can be long prose, unlike Name), or
+// Name otherwise.
+func (doc Document) text() string {
+	if doc.Docstring != "" {
+		return doc.Docstring
+	}
+	return doc.Name
+}
+
+// Result is a single ranked search hit.
+type Result struct {
+	Document Document
+	Score    float64
+}
+
+// Index is a case-folded trigram posting-list index. It is safe for
+// concurrent use: Add takes a write lock, and queries take a read lock.
+type Index struct {
+	mu       sync.RWMutex
+	postings map[string][]int // trigram -> document IDs, sorted ascending
+	docs     []Document
+}
+
+// New returns an empty Index.
+func New() *Index {
+	return &Index{postings: map[string][]int{}}
+}
+
+// Build constructs a trigram index from a flat list of documents. Callers
+// are expected to extract one Document per symbol name, docstring, and file
+// path captured while indexing a project.
+func Build(docs []Document) *Index {
+	idx := New()
+	for _, doc := range docs {
+		idx.Add(doc)
+	}
+	return idx
+}
+
+func trigrams(s string) []string {
+	s = strings.ToLower(s)
+	if len(s) < 3 {
+		return []string{s}
+	}
+	trigrams := make([]string, 0, len(s)-2)
+	for i := 0; i+3 <= len(s); i++ {
+		trigrams = append(trigrams, s[i:i+3])
+	}
+	return trigrams
+}
+
+// Add inserts a document into the index.
+func (idx *Index) Add(doc Document) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	id := len(idx.docs)
+	idx.docs = append(idx.docs, doc)
+	seen := map[string]struct{}{}
+	for _, t := range trigrams(doc.text()) {
+		if _, ok := seen[t]; ok {
+			continue
+		}
+		seen[t] = struct{}{}
+		idx.postings[t] = append(idx.postings[t], id)
+	}
+}
+
+// kindPriority ranks symbol matches above path matches above docstring
+// matches, since a user searching is most often looking for a symbol.
+func kindPriority(kind string) float64 {
+	switch kind {
+	case "symbol":
+		return 3
+	case "path":
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Query evaluates query against the index: it lowercases and trigrams the
+// query, intersects the shortest posting lists first to minimize candidate
+// set size, verifies each candidate with a substring match, and ranks
+// surviving candidates by symbol-kind priority plus query-token proximity.
+func (idx *Index) Query(ctx context.Context, query string) ([]Result, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, nil
+	}
+
+	queryTrigrams := trigrams(query)
+	lists := make([][]int, 0, len(queryTrigrams))
+	for _, t := range queryTrigrams {
+		list, ok := idx.postings[t]
+		if !ok {
+			// A missing trigram means no document can match.
+			return nil, nil
+		}
+		lists = append(lists, list)
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+
+	candidates := lists[0]
+	for _, list := range lists[1:] {
+		candidates = intersectSorted(candidates, list)
+		if len(candidates) == 0 {
+			return nil, nil
+		}
+	}
+
+	lowerQuery := strings.ToLower(query)
+	results := make([]Result, 0, len(candidates))
+	for _, id := range candidates {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		doc := idx.docs[id]
+		text := strings.ToLower(doc.text())
+		pos := strings.Index(text, lowerQuery)
+		if pos == -1 {
+			continue
+		}
+		proximity := 1.0 / float64(1+pos)
+		results = append(results, Result{Document: doc, Score: kindPriority(doc.Kind) + proximity})
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	return results, nil
+}
+
+// QueryRegexp matches documents against an arbitrary regexp instead of a
+// plain substring, for callers that want regex search semantics. It does not
+// use the trigram posting lists: every document in the index is tested.
+func (idx *Index) QueryRegexp(ctx context.Context, pattern *regexp.Regexp) ([]Result, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var results []Result
+	for _, doc := range idx.docs {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		if pattern.MatchString(doc.text()) {
+			results = append(results, Result{Document: doc, Score: kindPriority(doc.Kind)})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	return results, nil
+}
+
+func intersectSorted(a, b []int) []int {
+	out := make([]int, 0, min(len(a), len(b)))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, a[i])
+			i++
+			j++
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return out
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// shardPath returns the on-disk location of the persisted trigram index for
+// a project, stored alongside that project's JSON index files.
+func shardPath(indexDataDir, project string) string {
+	return filepath.Join(indexDataDir, project, "trigram.index")
+}
+
+// Load reads a project's persisted trigram index from indexDataDir. It
+// returns os.ErrNotExist (wrapped) if no index has been built yet, so
+// callers can fall back to a linear scan.
+func Load(indexDataDir, project string) (*Index, error) {
+	f, err := os.Open(shardPath(indexDataDir, project))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var docs []Document
+	if err := gob.NewDecoder(f).Decode(&docs); err != nil {
+		return nil, errors.Wrap(err, "Decode")
+	}
+
+	// Rebuild postings from the decoded documents rather than persisting
+	// them directly, since the posting lists are cheap to recompute and
+	// this keeps the on-disk format resilient to trigram logic changes.
+	idx := New()
+	for _, doc := range docs {
+		idx.Add(doc)
+	}
+	return idx, nil
+}
+
+// Save persists a project's trigram index to indexDataDir.
+func Save(indexDataDir, project string, idx *Index) error {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	path := shardPath(indexDataDir, project)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return errors.Wrap(err, "MkdirAll")
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "Create")
+	}
+	defer f.Close()
+
+	if err := gob.NewEncoder(f).Encode(idx.docs); err != nil {
+		return errors.Wrap(err, "Encode")
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package search
+
+import (
+	"context"
+	"testing"
+)
+
+func TestQueryMatchesSymbolByName(t *testing.T) {
+	idx := Build([]Document{
+		{Project: "p", Path: "a.go", Name: "ParseConfig", Kind: "symbol"},
+		{Project: "p", Path: "b.go", Name: "WriteFile", Kind: "symbol"},
+	})
+
+	results, err := idx.Query(context.Background(), "parse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Document.Name != "ParseConfig" {
+		t.Fatalf("got %+v, want a single match on ParseConfig", results)
+	}
+}
+
+func TestQueryRanksSymbolsAboveDocstrings(t *testing.T) {
+	idx := Build([]Document{
+		{Project: "p", Path: "a.go", Name: "Config", Docstring: "holds the config for the server", Kind: "docstring"},
+		{Project: "p", Path: "b.go", Name: "Config", Kind: "symbol"},
+	})
+
+	results, err := idx.Query(context.Background(), "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if results[0].Document.Kind != "symbol" {
+		t.Fatalf("top result kind = %q, want symbol ranked first", results[0].Document.Kind)
+	}
+}
+
+func TestQueryDocstringKeepsSymbolName(t *testing.T) {
+	idx := Build([]Document{
+		{Project: "p", Path: "a.go", Name: "ParseConfig", Docstring: "parses the on-disk configuration file", Kind: "docstring"},
+	})
+
+	results, err := idx.Query(context.Background(), "on-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if results[0].Document.Name != "ParseConfig" {
+		t.Fatalf("Document.Name = %q, want the symbol name, not the docstring text", results[0].Document.Name)
+	}
+}
+
+func TestQueryNoMatch(t *testing.T) {
+	idx := Build([]Document{{Project: "p", Path: "a.go", Name: "ParseConfig", Kind: "symbol"}})
+
+	results, err := idx.Query(context.Background(), "zzz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Fatalf("got %d results, want 0", len(results))
+	}
+}
+
+func TestQueryEmptyQuery(t *testing.T) {
+	idx := Build([]Document{{Project: "p", Path: "a.go", Name: "ParseConfig", Kind: "symbol"}})
+
+	results, err := idx.Query(context.Background(), "   ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results != nil {
+		t.Fatalf("got %+v, want nil for an empty/whitespace query", results)
+	}
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	idx := Build([]Document{{Project: "p", Path: "a.go", Name: "ParseConfig", Kind: "symbol"}})
+
+	if err := Save(dir, "p", idx); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(dir, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := loaded.Query(context.Background(), "parse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results after round-trip, want 1", len(results))
+	}
+}
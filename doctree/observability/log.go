@@ -0,0 +1,125 @@
+package observability
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Level is a logging severity level, ordered from least to most severe.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// Logger is a small leveled logger that can emit either human-readable or
+// JSON lines, and attaches the request ID from ctx (if any) to every entry.
+type Logger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level Level
+	json  bool
+}
+
+// NewLogger returns a Logger writing to os.Stderr. jsonOutput selects
+// between a JSON-lines format (suitable for log aggregation) and a plain
+// human-readable format (the default for local development).
+func NewLogger(level Level, jsonOutput bool) *Logger {
+	return &Logger{out: os.Stderr, level: level, json: jsonOutput}
+}
+
+type logEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestID,omitempty"`
+}
+
+func (l *Logger) log(ctx context.Context, level Level, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	reqID, _ := ctx.Value(requestIDKey{}).(string)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.json {
+		entry := logEntry{Time: time.Now().UTC().Format(time.RFC3339Nano), Level: level.String(), Message: msg, RequestID: reqID}
+		_ = json.NewEncoder(l.out).Encode(entry)
+		return
+	}
+
+	if reqID != "" {
+		fmt.Fprintf(l.out, "%s [%s] [%s] %s\n", time.Now().UTC().Format(time.RFC3339), level.String(), reqID, msg)
+	} else {
+		fmt.Fprintf(l.out, "%s [%s] %s\n", time.Now().UTC().Format(time.RFC3339), level.String(), msg)
+	}
+}
+
+func (l *Logger) Debug(ctx context.Context, format string, args ...interface{}) {
+	l.log(ctx, LevelDebug, format, args...)
+}
+
+func (l *Logger) Info(ctx context.Context, format string, args ...interface{}) {
+	l.log(ctx, LevelInfo, format, args...)
+}
+
+func (l *Logger) Warn(ctx context.Context, format string, args ...interface{}) {
+	l.log(ctx, LevelWarn, format, args...)
+}
+
+func (l *Logger) Error(ctx context.Context, format string, args ...interface{}) {
+	l.log(ctx, LevelError, format, args...)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying id, so loggers downstream can
+// correlate log lines for a single request.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or "" if none was set.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID generates a short random request ID suitable for log
+// correlation and response headers.
+func NewRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand failing is effectively unrecoverable and would
+		// indicate a broken host; a fixed fallback keeps logging itself
+		// from becoming a source of crashes.
+		return "00000000"
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,124 @@
+// Package observability holds the Prometheus metrics and structured logger
+// shared by doctree's serve command.
+package observability
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Registry is the Prometheus registry doctree's /metrics endpoint serves.
+// It's a dedicated registry, rather than prometheus.DefaultRegisterer, so
+// the exposed metric set stays limited to what doctree itself reports (no
+// default Go runtime collector noise unless explicitly registered below).
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTP request metrics, labeled by path/method/status.
+	HTTPRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "doctree",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Total number of HTTP requests handled, by path, method, and status.",
+	}, []string{"path", "method", "status"})
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "doctree",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency in seconds, by path and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"path", "method"})
+
+	// HTTP response cache metrics.
+	HTTPCacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "doctree",
+		Subsystem: "http",
+		Name:      "cache_hits_total",
+		Help:      "Total number of response cache hits across /api/list, /api/get, and /api/search.",
+	})
+
+	HTTPCacheMissesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "doctree",
+		Subsystem: "http",
+		Name:      "cache_misses_total",
+		Help:      "Total number of response cache misses across /api/list, /api/get, and /api/search.",
+	})
+
+	// Indexer run metrics, labeled by project and language.
+	IndexerRunsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "doctree",
+		Subsystem: "indexer",
+		Name:      "runs_total",
+		Help:      "Total number of indexer runs, by project and language.",
+	}, []string{"project", "language"})
+
+	IndexerRunDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "doctree",
+		Subsystem: "indexer",
+		Name:      "run_duration_seconds",
+		Help:      "Indexer run duration in seconds, by project and language.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"project", "language"})
+
+	// Search query metrics.
+	SearchQueryLength = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "doctree",
+		Subsystem: "search",
+		Name:      "query_length",
+		Help:      "Length in bytes of incoming search queries.",
+		Buckets:   []float64{1, 2, 4, 8, 16, 32, 64, 128},
+	})
+
+	SearchResultCount = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "doctree",
+		Subsystem: "search",
+		Name:      "result_count",
+		Help:      "Number of results returned per search query.",
+		Buckets:   []float64{0, 1, 5, 10, 25, 50, 100, 250},
+	})
+
+	SearchQueryDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "doctree",
+		Subsystem: "search",
+		Name:      "query_duration_seconds",
+		Help:      "Search query latency in seconds.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// Watcher metrics.
+	WatcherEventsBatchedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "doctree",
+		Subsystem: "watcher",
+		Name:      "events_batched_total",
+		Help:      "Total number of raw filesystem events folded into a debounce burst.",
+	})
+
+	WatcherEventsDebouncedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "doctree",
+		Subsystem: "watcher",
+		Name:      "events_debounced_total",
+		Help:      "Total number of debounce bursts that settled without triggering a reindex.",
+	})
+
+	WatcherReindexTriggeredTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "doctree",
+		Subsystem: "watcher",
+		Name:      "reindex_triggered_total",
+		Help:      "Total number of reindexes triggered by the filesystem watcher.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		HTTPRequestsTotal,
+		HTTPRequestDuration,
+		HTTPCacheHitsTotal,
+		HTTPCacheMissesTotal,
+		IndexerRunsTotal,
+		IndexerRunDuration,
+		SearchQueryLength,
+		SearchResultCount,
+		SearchQueryDuration,
+		WatcherEventsBatchedTotal,
+		WatcherEventsDebouncedTotal,
+		WatcherReindexTriggeredTotal,
+	)
+}